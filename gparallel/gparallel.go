@@ -2,57 +2,744 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
-	"golang.org/x/sync/semaphore"
+	"flag"
+	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sync/semaphore"
 )
 
 const (
-	MaxProcesses       = 4
-	MaxLinesPerProcess = 3
+	DefaultLinesPerBatch   = 3
+	DefaultRetryDelay      = 100 * time.Millisecond
+	DefaultRetryMaxDelay   = 10 * time.Second
+	DefaultHaltGracePeriod = 5 * time.Second
+	StderrTailBytes        = 4096
+
+	// ExitStatusDefault is used when a batch failed but its exit code was
+	// 0 or unavailable, matching xargs' generic "command failed" status.
+	ExitStatusDefault = 123
+	// ExitStatusInternalError is used for failures that never produced a
+	// real child exit code (e.g. the subprocess could not be started).
+	ExitStatusInternalError = 125
+
+	// AckSentinel is the line a child must echo to stdout, under
+	// --ack-protocol, to acknowledge it has consumed one input line.
+	AckSentinel = "\x01GPARALLEL-ACK\x01"
 )
 
-func subprocess(lines <-chan string, done *semaphore.Weighted) {
-	defer done.Release(1)
-	cmd := exec.Command(os.Args[1], os.Args[2:]...)
+// Config holds the parallelism and batching parameters for a run, gathered
+// from CLI flags (with environment variable fallbacks) instead of being
+// read ad-hoc from os.Args deep inside the dispatcher.
+type Config struct {
+	Jobs             int
+	LinesPerBatch    int
+	MaxBytesPerBatch int
+	Null             bool
+	Retries          int
+	RetryDelay       time.Duration
+	RetryMaxDelay    time.Duration
+	NoRetryExitCodes map[int]bool
+	KeepOrder        bool
+	LineBuffer       bool
+	HaltOnError      bool
+	HaltGracePeriod  time.Duration
+	Persistent       bool
+	AckProtocol      bool
+	Command          []string
+}
+
+// buffersOutput reports whether batch output must be captured per-subprocess
+// instead of going straight to os.Stdout/os.Stderr.
+func (c *Config) buffersOutput() bool {
+	return c.KeepOrder || c.LineBuffer
+}
+
+// delimiter is the separator written after each item on a child's stdin,
+// matching whatever scanNull/bufio.ScanLines split the input on, so that
+// --null items (which may contain embedded newlines) stay unambiguous.
+func (c *Config) delimiter() string {
+	if c.Null {
+		return "\x00"
+	}
+	return "\n"
+}
+
+// parseExitCodeSet parses a comma-separated list of exit codes, as accepted
+// by --no-retry-exit-codes, into a lookup set.
+func parseExitCodeSet(s string) (map[int]bool, error) {
+	set := make(map[int]bool)
+	if s == "" {
+		return set, nil
+	}
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		code, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exit code %q: %w", field, err)
+		}
+		set[code] = true
+	}
+	return set, nil
+}
+
+// envInt returns the integer value of the named environment variable, or
+// fallback if the variable is unset or not a valid integer.
+func envInt(name string, fallback int) int {
+	if v := os.Getenv(name); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return fallback
+}
+
+// parseConfig builds a Config from args[1:], stopping at a literal "--"
+// so that everything after it is left untouched as the child command.
+func parseConfig(args []string) (*Config, error) {
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	cfg := &Config{}
+
+	jobsDefault := envInt("XARGS_JOBS", runtime.NumCPU())
+	batchDefault := envInt("XARGS_BATCH", DefaultLinesPerBatch)
+
+	fs.IntVar(&cfg.Jobs, "j", jobsDefault, "number of subprocesses to run in parallel")
+	fs.IntVar(&cfg.Jobs, "jobs", jobsDefault, "number of subprocesses to run in parallel")
+	fs.IntVar(&cfg.LinesPerBatch, "n", batchDefault, "number of input lines to feed to each subprocess")
+	fs.IntVar(&cfg.LinesPerBatch, "lines-per-batch", batchDefault, "number of input lines to feed to each subprocess")
+	fs.IntVar(&cfg.MaxBytesPerBatch, "L", 0, "max input bytes per subprocess batch (0 disables byte-based batching)")
+	fs.IntVar(&cfg.MaxBytesPerBatch, "max-bytes-per-batch", 0, "max input bytes per subprocess batch (0 disables byte-based batching)")
+	fs.BoolVar(&cfg.Null, "0", false, "input items are terminated by a NUL byte instead of a newline")
+	fs.BoolVar(&cfg.Null, "null", false, "input items are terminated by a NUL byte instead of a newline")
+	fs.IntVar(&cfg.Retries, "retries", 0, "number of times to retry a batch whose subprocess exits non-zero")
+	fs.DurationVar(&cfg.RetryDelay, "retry-delay", DefaultRetryDelay, "base delay between retries, doubled after each attempt")
+	fs.DurationVar(&cfg.RetryMaxDelay, "retry-max-delay", DefaultRetryMaxDelay, "cap on the exponential retry backoff delay")
+	noRetryExitCodes := fs.String("no-retry-exit-codes", "", "comma-separated exit codes treated as fatal (never retried)")
+	fs.BoolVar(&cfg.KeepOrder, "keep-order", false, "flush batch output in submission order instead of interleaving")
+	fs.BoolVar(&cfg.LineBuffer, "line-buffer", false, "flush whole batch output atomically, in completion order")
+	fs.BoolVar(&cfg.HaltOnError, "halt-on-error", false, "stop starting new batches once any batch fails, and terminate running ones")
+	fs.DurationVar(&cfg.HaltGracePeriod, "halt-grace-period", DefaultHaltGracePeriod, "time to wait after SIGTERM before SIGKILL when halting")
+	fs.BoolVar(&cfg.Persistent, "persistent", false, "keep a pool of -j long-lived workers and round-robin lines to their stdin, instead of batching")
+	fs.BoolVar(&cfg.AckProtocol, "ack-protocol", false, "expect the child to echo an ack sentinel per consumed line, for replay after a respawn (requires --persistent)")
+
+	if err := fs.Parse(args[1:]); err != nil {
+		return nil, err
+	}
+
+	if cfg.Jobs < 1 {
+		return nil, fmt.Errorf("-j/--jobs must be at least 1, got %d", cfg.Jobs)
+	}
+	if cfg.LinesPerBatch < 0 {
+		return nil, fmt.Errorf("-n/--lines-per-batch must not be negative, got %d", cfg.LinesPerBatch)
+	}
+	if cfg.MaxBytesPerBatch < 0 {
+		return nil, fmt.Errorf("-L/--max-bytes-per-batch must not be negative, got %d", cfg.MaxBytesPerBatch)
+	}
+
+	var err error
+	cfg.NoRetryExitCodes, err = parseExitCodeSet(*noRetryExitCodes)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.Command = fs.Args()
+	if len(cfg.Command) == 0 {
+		return nil, fmt.Errorf("no command given; usage: %s [flags] -- command [args...]", args[0])
+	}
+	if cfg.AckProtocol && !cfg.Persistent {
+		return nil, fmt.Errorf("--ack-protocol requires --persistent")
+	}
+	if cfg.Persistent && (cfg.KeepOrder || cfg.LineBuffer) {
+		return nil, fmt.Errorf("--persistent does not support --keep-order/--line-buffer")
+	}
+	if cfg.Persistent && (cfg.HaltOnError || cfg.Retries > 0 || len(cfg.NoRetryExitCodes) > 0) {
+		return nil, fmt.Errorf("--persistent does not support --halt-on-error/--retries/--no-retry-exit-codes")
+	}
+
+	return cfg, nil
+}
+
+// scanNull is a bufio.SplitFunc that splits input on NUL bytes instead of
+// newlines, mirroring xargs -0 / find -print0 so filenames containing
+// newlines are handled safely.
+func scanNull(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	for i, b := range data {
+		if b == 0 {
+			return i + 1, data[:i], nil
+		}
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// tailWriter keeps only the last max bytes written to it, for attaching a
+// short stderr excerpt to a failure report without buffering everything.
+type tailWriter struct {
+	buf []byte
+	max int
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(p), nil
+}
+
+// batchResult is everything runBatch learns about one subprocess attempt.
+type batchResult struct {
+	pid      int
+	exitCode int
+	stderr   string
+}
+
+// runBatch starts cfg.Command, streams batch to its stdin, and waits for it
+// to finish or for ctx to be cancelled. Output goes to stdout and stderr,
+// which are os.Stdout/os.Stderr unless output is being buffered for ordered
+// or line-buffered flushing. When ctx is cancelled while the child is
+// running, it is sent SIGTERM and, if it hasn't exited within
+// cfg.HaltGracePeriod, SIGKILL.
+func runBatch(ctx context.Context, cfg *Config, batch []string, stdout, stderr io.Writer) batchResult {
+	cmd := exec.Command(cfg.Command[0], cfg.Command[1:]...)
+	tail := &tailWriter{max: StderrTailBytes}
 	pipe, _ := cmd.StdinPipe()
-	cmd.Stdout = os.Stdout
+	cmd.Stdout = stdout
+	cmd.Stderr = io.MultiWriter(stderr, tail)
+	if err := cmd.Start(); err != nil {
+		return batchResult{exitCode: -1}
+	}
+
+	waitDone := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = cmd.Process.Signal(syscall.SIGTERM)
+			select {
+			case <-waitDone:
+			case <-time.After(cfg.HaltGracePeriod):
+				_ = cmd.Process.Signal(syscall.SIGKILL)
+			}
+		case <-waitDone:
+		}
+	}()
+
+	for _, line := range batch {
+		_, _ = io.WriteString(pipe, line+cfg.delimiter())
+	}
+	_ = pipe.Close()
+	err := cmd.Wait()
+	close(waitDone)
+
+	result := batchResult{pid: cmd.Process.Pid, stderr: string(tail.buf)}
+	if err == nil {
+		return result
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		result.exitCode = exitErr.ExitCode()
+		return result
+	}
+	result.exitCode = -1
+	return result
+}
+
+// batchOutput carries one subprocess batch's captured stdout/stderr, tagged
+// with the batch's submission sequence number so a flusher can reorder it.
+type batchOutput struct {
+	seq    int
+	stdout *bytes.Buffer
+	stderr *bytes.Buffer
+}
+
+// batchFailure is a structured record of a batch that exhausted its retries,
+// collected for the end-of-run summary and exit status.
+type batchFailure struct {
+	pid        int
+	cmd        []string
+	exitCode   int
+	stderrTail string
+	inputLines []string
+}
+
+// nextDelay doubles delay for the next retry/respawn attempt, capped at maxDelay.
+func nextDelay(delay, maxDelay time.Duration) time.Duration {
+	delay *= 2
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+// subprocess buffers its batch (so it can be replayed) and runs it, retrying
+// with exponential backoff on a non-fatal non-zero exit up to cfg.Retries
+// times. On final failure it reports a batchFailure on failures and, if
+// cfg.HaltOnError is set, cancels the run via haltCause. When outputs is
+// non-nil, stdout/stderr are captured per-attempt and handed to the flusher
+// goroutine instead of being written directly.
+func subprocess(ctx context.Context, cfg *Config, lines <-chan string, done *semaphore.Weighted, failures chan<- batchFailure, haltCause context.CancelFunc, seq int, outputs chan<- batchOutput) {
+	defer done.Release(1)
+
+	batch := make([]string, 0, cfg.LinesPerBatch+1)
+	for line := range lines {
+		batch = append(batch, line)
+	}
+
+	var stdout, stderr io.Writer
+	var stdoutBuf, stderrBuf *bytes.Buffer
+	var result batchResult
+
+	delay := cfg.RetryDelay
+	for attempt := 0; ; attempt++ {
+		stdout, stderr = os.Stdout, os.Stderr
+		if outputs != nil {
+			stdoutBuf, stderrBuf = &bytes.Buffer{}, &bytes.Buffer{}
+			stdout, stderr = stdoutBuf, stderrBuf
+		}
+
+		result = runBatch(ctx, cfg, batch, stdout, stderr)
+		if result.exitCode == 0 {
+			break
+		}
+		if cfg.NoRetryExitCodes[result.exitCode] || attempt >= cfg.Retries || ctx.Err() != nil {
+			failures <- batchFailure{
+				pid:        result.pid,
+				cmd:        cfg.Command,
+				exitCode:   result.exitCode,
+				stderrTail: result.stderr,
+				inputLines: batch,
+			}
+			if cfg.HaltOnError {
+				haltCause()
+			}
+			break
+		}
+		time.Sleep(delay)
+		delay = nextDelay(delay, cfg.RetryMaxDelay)
+	}
+
+	if outputs != nil {
+		outputs <- batchOutput{seq: seq, stdout: stdoutBuf, stderr: stderrBuf}
+	}
+}
+
+// flushOutputs drains captured batch output to the real stdout/stderr. In
+// --keep-order mode, batch seq is only flushed once every earlier seq has
+// been flushed; otherwise batches are flushed as soon as they complete.
+func flushOutputs(cfg *Config, outputs <-chan batchOutput, done chan<- struct{}) {
+	defer close(done)
+
+	if !cfg.KeepOrder {
+		for out := range outputs {
+			os.Stdout.Write(out.stdout.Bytes())
+			os.Stderr.Write(out.stderr.Bytes())
+		}
+		return
+	}
+
+	next := 0
+	pending := make(map[int]batchOutput)
+	for out := range outputs {
+		pending[out.seq] = out
+		for ready, ok := pending[next]; ok; ready, ok = pending[next] {
+			os.Stdout.Write(ready.stdout.Bytes())
+			os.Stderr.Write(ready.stderr.Bytes())
+			delete(pending, next)
+			next++
+		}
+	}
+}
+
+// persistentWorker is one long-lived child process in --persistent mode. Its
+// stdin pipe stays open for the whole run; lines are dispatched to it
+// directly instead of being batched and handed to a freshly exec'd process.
+type persistentWorker struct {
+	id  int
+	cfg *Config
+
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	stdoutW io.Closer // the ack-protocol pipe handed to cmd.Stdout; exec never closes it itself
+	pending []string  // lines sent but not yet acked; only tracked under --ack-protocol
+	closed  bool      // set once shutdown has closed this worker's stdin
+
+	shutdown atomic.Bool
+}
+
+func newPersistentWorker(id int, cfg *Config) *persistentWorker {
+	w := &persistentWorker{id: id, cfg: cfg}
+	w.spawn()
+	return w
+}
+
+// spawn execs cfg.Command and installs it as the worker's current child. If
+// shutdown has already closed a previous stdin (closeStdin raced a respawn
+// triggered by the old child dying), the new stdin is closed immediately
+// instead of being left open forever.
+func (w *persistentWorker) spawn() {
+	cmd := exec.Command(w.cfg.Command[0], w.cfg.Command[1:]...)
+	stdin, _ := cmd.StdinPipe()
 	cmd.Stderr = os.Stderr
+	var stdoutW io.Closer
+	if w.cfg.AckProtocol {
+		stdoutR, pw := io.Pipe()
+		cmd.Stdout = pw
+		stdoutW = pw
+		go w.consumeAcks(stdoutR)
+	} else {
+		cmd.Stdout = os.Stdout
+	}
 	_ = cmd.Start()
-	for line := range lines {
-		_, _ = io.WriteString(pipe, line+"\n")
+
+	w.mu.Lock()
+	w.cmd, w.stdin, w.stdoutW = cmd, stdin, stdoutW
+	closed := w.closed
+	w.mu.Unlock()
+
+	if closed {
+		_ = stdin.Close()
 	}
-	_ = pipe.Close()
-	_ = cmd.Wait()
+}
+
+// consumeAcks reads the child's stdout, swallowing AckSentinel lines to
+// drop the oldest pending (unacked) line and forwarding everything else.
+func (w *persistentWorker) consumeAcks(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := scanner.Text(); line == AckSentinel {
+			w.mu.Lock()
+			if len(w.pending) > 0 {
+				w.pending = w.pending[1:]
+			}
+			w.mu.Unlock()
+		} else {
+			fmt.Println(line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "gparallel: worker %d: reading ack stream: %v\n", w.id, err)
+	}
+}
+
+// send writes one line to the worker's current child, tracking it as
+// pending when --ack-protocol is enabled so it can be replayed on respawn.
+func (w *persistentWorker) send(line string) error {
+	w.mu.Lock()
+	stdin := w.stdin
+	if w.cfg.AckProtocol {
+		w.pending = append(w.pending, line)
+	}
+	w.mu.Unlock()
+	_, err := io.WriteString(stdin, line+w.cfg.delimiter())
+	return err
+}
+
+// closeStdin closes the worker's current stdin and marks it closed so a
+// respawn racing this shutdown closes its own (newer) stdin too, instead of
+// leaving a child blocked reading from a pipe nobody will ever close.
+func (w *persistentWorker) closeStdin() {
+	w.mu.Lock()
+	w.closed = true
+	stdin := w.stdin
+	w.mu.Unlock()
+	_ = stdin.Close()
+}
+
+// wait blocks until the worker's current child exits. exec.Cmd never closes
+// a non-*os.File cmd.Stdout on its own, so this also closes the ack-protocol
+// pipe writer (if any), letting consumeAcks's goroutine see EOF and return
+// instead of leaking on every respawn.
+func (w *persistentWorker) wait() (int, error) {
+	w.mu.Lock()
+	cmd, stdoutW := w.cmd, w.stdoutW
+	w.mu.Unlock()
+	err := cmd.Wait()
+	if stdoutW != nil {
+		_ = stdoutW.Close()
+	}
+	if cmd.Process == nil {
+		return -1, err
+	}
+	return cmd.Process.Pid, err
+}
+
+// pendingSnapshot returns a copy of the lines sent but not yet acked.
+func (w *persistentWorker) pendingSnapshot() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.pending...)
+}
+
+// respawn replaces a dead child with a fresh one, replays whatever lines
+// were written to the old one but never acked, and returns those lines.
+func (w *persistentWorker) respawn() []string {
+	w.mu.Lock()
+	replay := append([]string(nil), w.pending...)
+	w.pending = nil
+	w.mu.Unlock()
+
+	w.spawn()
+	for _, line := range replay {
+		_ = w.send(line)
+	}
+	return replay
+}
+
+// supervise waits for the worker's child to exit and, unless shutdown has
+// been requested (stdin closed, input done), respawns it. Closing stdin at
+// shutdown races the child's own exit, so whether to respawn (governed by
+// the shutdown flag) is kept independent of whether to report a failure
+// (governed purely by the exit status): a child that crashes right as
+// shutdown begins must still be reflected in the run's final exit status,
+// the same as a failed batch in batch mode.
+//
+// A child that dies faster than it takes to respawn (e.g. a poison input
+// line replayed identically after every respawn under --ack-protocol) is
+// throttled with the same exponential-backoff/cap scheme as batch retries,
+// so a crash loop can't fork/exec with no delay between attempts. A child
+// that survives at least one backoff window is treated as healthy again and
+// the delay resets, so one flaky crash after a long clean run isn't
+// penalized by backoff left over from an earlier crash loop. The backoff
+// wait itself polls the shutdown flag instead of sleeping the full delay, so
+// a shutdown mid-backoff doesn't stall the run for up to RetryMaxDelay.
+func (w *persistentWorker) supervise(wg *sync.WaitGroup, failures chan<- batchFailure) {
+	defer wg.Done()
+	delay := w.cfg.RetryDelay
+	spawnedAt := time.Now()
+	for {
+		pid, err := w.wait()
+
+		exitCode := 0
+		if err != nil {
+			exitCode = -1
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				exitCode = exitErr.ExitCode()
+			}
+		}
+
+		if exitCode == 0 || time.Since(spawnedAt) >= delay {
+			delay = w.cfg.RetryDelay
+		} else {
+			w.sleepUnlessShutdown(delay)
+			delay = nextDelay(delay, w.cfg.RetryMaxDelay)
+		}
+
+		if w.shutdown.Load() {
+			if exitCode != 0 {
+				failures <- batchFailure{pid: pid, cmd: w.cfg.Command, exitCode: exitCode, inputLines: w.pendingSnapshot()}
+			}
+			return
+		}
+
+		if exitCode != 0 {
+			fmt.Fprintf(os.Stderr, "gparallel: persistent worker %d died (%v); respawning\n", w.id, err)
+		}
+
+		replayed := w.respawn()
+		spawnedAt = time.Now()
+		if exitCode != 0 {
+			failures <- batchFailure{pid: pid, cmd: w.cfg.Command, exitCode: exitCode, inputLines: replayed}
+		}
+	}
+}
+
+// sleepUnlessShutdown sleeps for d, checking the shutdown flag in small
+// steps so a shutdown requested mid-backoff wakes it early instead of
+// stalling the run for up to the full (possibly multi-second) delay.
+func (w *persistentWorker) sleepUnlessShutdown(d time.Duration) {
+	const pollInterval = 20 * time.Millisecond
+	for d > 0 && !w.shutdown.Load() {
+		step := pollInterval
+		if step > d {
+			step = d
+		}
+		time.Sleep(step)
+		d -= step
+	}
+}
+
+// runPersistent implements --persistent: a fixed pool of cfg.Jobs workers
+// whose stdin pipes stay open for the whole run, round-robin fed one
+// scanned line at a time. This avoids the per-batch exec.Command startup
+// cost that dominates when children are short-lived. It returns the same
+// worst-exit-code status as the batch dispatcher.
+func runPersistent(cfg *Config) int {
+	failures := make(chan batchFailure, cfg.Jobs)
+	failuresDone := make(chan []batchFailure)
+	go func() { failuresDone <- collectFailures(failures) }()
+
+	workers := make([]*persistentWorker, cfg.Jobs)
+	var wg sync.WaitGroup
+	for i := range workers {
+		workers[i] = newPersistentWorker(i, cfg)
+		wg.Add(1)
+		go workers[i].supervise(&wg, failures)
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	if cfg.Null {
+		scanner.Split(scanNull)
+	}
+
+	next := 0
+	for scanner.Scan() {
+		w := workers[next]
+		if err := w.send(scanner.Text()); err != nil {
+			fmt.Fprintf(os.Stderr, "gparallel: worker %d write failed: %v\n", w.id, err)
+		}
+		next = (next + 1) % len(workers)
+	}
+
+	for _, w := range workers {
+		w.shutdown.Store(true)
+		w.closeStdin()
+	}
+	wg.Wait()
+
+	close(failures)
+	return reportFailures(<-failuresDone)
 }
 
 func main() {
+	cfg, err := parseConfig(os.Args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if cfg.Persistent {
+		os.Exit(runPersistent(cfg))
+	}
+
 	var linesChannel chan string
-	ctx := context.Background()
+	bgCtx := context.Background()
+	runCtx, halt := context.WithCancel(bgCtx)
+	defer halt()
 	scanner := bufio.NewScanner(os.Stdin)
-	linesRemaining := 0
-	processesRunning := semaphore.NewWeighted(MaxProcesses)
+	if cfg.Null {
+		scanner.Split(scanNull)
+	}
+	processesRunning := semaphore.NewWeighted(int64(cfg.Jobs))
+
+	failures := make(chan batchFailure, cfg.Jobs)
+	failuresDone := make(chan []batchFailure)
+	go func() { failuresDone <- collectFailures(failures) }()
+
+	var outputs chan batchOutput
+	var flusherDone chan struct{}
+	if cfg.buffersOutput() {
+		outputs = make(chan batchOutput, cfg.Jobs)
+		flusherDone = make(chan struct{})
+		go flushOutputs(cfg, outputs, flusherDone)
+	}
+
+	seq := 0
+	lineCount := 0
+	byteCount := 0
+
+	batchFull := func() bool {
+		if cfg.LinesPerBatch > 0 && lineCount >= cfg.LinesPerBatch {
+			return true
+		}
+		if cfg.MaxBytesPerBatch > 0 && byteCount >= cfg.MaxBytesPerBatch {
+			return true
+		}
+		return false
+	}
 
 	for scanner.Scan() {
-		if linesRemaining == 0 {
-			linesRemaining = MaxLinesPerProcess
-			_ = processesRunning.Acquire(ctx, 1)
-			linesChannel = make(chan string, MaxLinesPerProcess)
-			go subprocess(linesChannel, processesRunning)
+		if linesChannel == nil {
+			if err := processesRunning.Acquire(runCtx, 1); err != nil {
+				break // halted: stop starting new batches
+			}
+			linesChannel = make(chan string, cfg.LinesPerBatch+1)
+			go subprocess(runCtx, cfg, linesChannel, processesRunning, failures, halt, seq, outputs)
+			seq++
 		}
 
-		linesChannel <- scanner.Text()
-		linesRemaining--
+		line := scanner.Text()
+		linesChannel <- line
+		lineCount++
+		byteCount += len(line) + 1
 
-		if linesRemaining == 0 {
+		if batchFull() {
 			close(linesChannel)
+			linesChannel = nil
+			lineCount = 0
+			byteCount = 0
 		}
 	}
 
-	if linesRemaining > 0 {
+	if linesChannel != nil {
 		close(linesChannel)
 	}
-	_ = processesRunning.Acquire(ctx, MaxProcesses)
+	_ = processesRunning.Acquire(bgCtx, int64(cfg.Jobs))
+
+	if outputs != nil {
+		close(outputs)
+		<-flusherDone
+	}
+
+	close(failures)
+	failed := <-failuresDone
+
+	os.Exit(reportFailures(failed))
+}
+
+// collectFailures drains ch into a slice; it returns once ch is closed.
+func collectFailures(ch <-chan batchFailure) []batchFailure {
+	var collected []batchFailure
+	for f := range ch {
+		collected = append(collected, f)
+	}
+	return collected
+}
+
+// reportFailures prints a summary of failed batches to stderr (if any) and
+// returns the process exit status: 0 if nothing failed, otherwise the worst
+// exit code observed (falling back to ExitStatusDefault/ExitStatusInternalError).
+func reportFailures(failures []batchFailure) int {
+	if len(failures) == 0 {
+		return 0
+	}
+
+	fmt.Fprintf(os.Stderr, "gparallel: %d batch(es) failed:\n", len(failures))
+	worst := 0
+	for _, f := range failures {
+		code := f.exitCode
+		if code <= 0 {
+			code = ExitStatusInternalError
+		}
+		if code > worst {
+			worst = code
+		}
+		fmt.Fprintf(os.Stderr, "  pid %d: %s exited %d (%d input line(s))\n",
+			f.pid, strings.Join(f.cmd, " "), f.exitCode, len(f.inputLines))
+		if f.stderrTail != "" {
+			fmt.Fprintf(os.Stderr, "    stderr: %s\n", f.stderrTail)
+		}
+	}
+	if worst == 0 {
+		worst = ExitStatusDefault
+	}
+	return worst
 }
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// TestParseConfigRejectsInvalidBatchingFlags checks that -j/-n/-L values
+// that would otherwise hang or panic downstream (a zero or negative job
+// count, a negative batch size) are rejected up front with a clean error.
+func TestParseConfigRejectsInvalidBatchingFlags(t *testing.T) {
+	cases := []struct {
+		name string
+		args []string
+	}{
+		{"zero jobs", []string{"gparallel", "-j", "0", "--", "true"}},
+		{"negative jobs", []string{"gparallel", "-j", "-1", "--", "true"}},
+		{"negative lines-per-batch", []string{"gparallel", "-n", "-5", "--", "true"}},
+		{"negative max-bytes-per-batch", []string{"gparallel", "-L", "-5", "--", "true"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := parseConfig(tc.args); err == nil {
+				t.Fatalf("parseConfig(%v) = nil error, want a rejection", tc.args)
+			}
+		})
+	}
+}
+
+// TestParseConfigRejectsPersistentWithBatchRetryFlags checks that
+// --halt-on-error/--retries/--no-retry-exit-codes, which persistent workers
+// never consult, are rejected instead of silently doing nothing.
+func TestParseConfigRejectsPersistentWithBatchRetryFlags(t *testing.T) {
+	cases := []struct {
+		name string
+		args []string
+	}{
+		{"halt-on-error", []string{"gparallel", "--persistent", "--halt-on-error", "--", "true"}},
+		{"retries", []string{"gparallel", "--persistent", "--retries", "3", "--", "true"}},
+		{"no-retry-exit-codes", []string{"gparallel", "--persistent", "--no-retry-exit-codes", "1", "--", "true"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := parseConfig(tc.args); err == nil {
+				t.Fatalf("parseConfig(%v) = nil error, want a rejection", tc.args)
+			}
+		})
+	}
+
+	// Plain --persistent with no batch-retry flags must still be accepted.
+	if _, err := parseConfig([]string{"gparallel", "--persistent", "--", "true"}); err != nil {
+		t.Fatalf("parseConfig(--persistent) = %v, want no error", err)
+	}
+}
+
+// captureStdout redirects os.Stdout for the duration of fn and returns
+// whatever was written to it.
+func captureStdout(t *testing.T, fn func()) []byte {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("os.Pipe: %v", err)
+	}
+	orig := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = orig }()
+
+	fn()
+
+	_ = w.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading captured stdout: %v", err)
+	}
+	return out
+}
+
+// TestSubprocessRetrySucceedsAfterFailures exercises the retry/backoff loop:
+// a batch that fails a few times before succeeding should not be reported as
+// a failure, and should have been attempted more than once.
+func TestSubprocessRetrySucceedsAfterFailures(t *testing.T) {
+	counter := scratchFile(t)
+	cfg := &Config{
+		Command:       []string{"bash", "-c", `n=$(cat "$1" 2>/dev/null || echo 0); n=$((n+1)); echo $n > "$1"; [ "$n" -ge 3 ]`, "_", counter},
+		LinesPerBatch: 1,
+		Retries:       5,
+		RetryDelay:    5 * time.Millisecond,
+		RetryMaxDelay: 20 * time.Millisecond,
+	}
+
+	lines := make(chan string, 1)
+	lines <- "x"
+	close(lines)
+
+	failures := make(chan batchFailure, 1)
+	done := semaphore.NewWeighted(1)
+	_ = done.Acquire(context.Background(), 1)
+
+	subprocess(context.Background(), cfg, lines, done, failures, func() {}, 0, nil)
+	close(failures)
+
+	if fs := collectFailures(failures); len(fs) != 0 {
+		t.Fatalf("expected no failures after eventual success, got %+v", fs)
+	}
+}
+
+// TestSubprocessHaltOnErrorStopsRetrying checks that once the run's context
+// is cancelled (as --halt-on-error does), a batch's retry loop treats the
+// cancellation as terminal instead of sleeping through its full backoff
+// budget.
+func TestSubprocessHaltOnErrorStopsRetrying(t *testing.T) {
+	cfg := &Config{
+		Command:       []string{"false"},
+		LinesPerBatch: 1,
+		Retries:       5,
+		RetryDelay:    300 * time.Millisecond,
+		RetryMaxDelay: time.Second,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // simulate a halt that already happened
+
+	lines := make(chan string, 1)
+	lines <- "x"
+	close(lines)
+
+	failures := make(chan batchFailure, 1)
+	done := semaphore.NewWeighted(1)
+	_ = done.Acquire(context.Background(), 1)
+
+	start := time.Now()
+	subprocess(ctx, cfg, lines, done, failures, func() {}, 0, nil)
+	elapsed := time.Since(start)
+	close(failures)
+
+	if fs := collectFailures(failures); len(fs) != 1 {
+		t.Fatalf("expected exactly one failure, got %+v", fs)
+	}
+	if elapsed > 250*time.Millisecond {
+		t.Fatalf("subprocess took %v, want well under one retry-delay (%v); ctx.Err() should have short-circuited retries", elapsed, cfg.RetryDelay)
+	}
+}
+
+// TestFlushOutputsKeepOrder checks that --keep-order buffers out-of-order
+// batch completions and flushes them in submission order.
+func TestFlushOutputsKeepOrder(t *testing.T) {
+	cfg := &Config{KeepOrder: true}
+	outputs := make(chan batchOutput, 3)
+	done := make(chan struct{})
+
+	out := captureStdout(t, func() {
+		go flushOutputs(cfg, outputs, done)
+
+		outputs <- batchOutput{seq: 1, stdout: bytes.NewBufferString("b\n"), stderr: &bytes.Buffer{}}
+		outputs <- batchOutput{seq: 0, stdout: bytes.NewBufferString("a\n"), stderr: &bytes.Buffer{}}
+		outputs <- batchOutput{seq: 2, stdout: bytes.NewBufferString("c\n"), stderr: &bytes.Buffer{}}
+		close(outputs)
+		<-done
+	})
+
+	if got, want := string(out), "a\nb\nc\n"; got != want {
+		t.Fatalf("flushOutputs order = %q, want %q", got, want)
+	}
+}
+
+// TestPersistentWorkerRespawnReportsFailure checks that a persistent worker
+// whose child crashes is respawned, and that the crash is reported through
+// the failures channel instead of being silently absorbed.
+func TestPersistentWorkerRespawnReportsFailure(t *testing.T) {
+	cfg := &Config{Command: []string{"false"}}
+	w := newPersistentWorker(0, cfg)
+
+	// Buffered and continuously drained, mirroring runPersistent's own
+	// collectFailures goroutine: supervise respawns (and re-reports) a
+	// perpetually-failing child in a tight loop, so nothing must block on
+	// the failures channel while this test is still observing it.
+	failures := make(chan batchFailure, 16)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go w.supervise(&wg, failures)
+
+	select {
+	case f := <-failures:
+		if f.exitCode != 1 {
+			t.Fatalf("exitCode = %d, want 1", f.exitCode)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the crashed worker's failure to be reported")
+	}
+
+	w.shutdown.Store(true)
+	w.closeStdin()
+	waitTimeout(t, &wg, 2*time.Second)
+
+	// Drain whatever respawn attempts piled up while shutting down.
+	for {
+		select {
+		case <-failures:
+		default:
+			return
+		}
+	}
+}
+
+// TestPersistentWorkerRespawnBacksOff checks that a worker whose child dies
+// immediately on every respawn is throttled by an exponential backoff
+// instead of being re-exec'd in a tight loop: unthrottled, a 300ms window
+// would respawn hundreds of times; with a 20ms/200ms-capped backoff it
+// should respawn only a handful.
+func TestPersistentWorkerRespawnBacksOff(t *testing.T) {
+	counter := scratchFile(t)
+	cfg := &Config{
+		Command:       []string{"bash", "-c", `n=$(cat "$1" 2>/dev/null || echo 0); echo $((n+1)) > "$1"; exit 1`, "_", counter},
+		RetryDelay:    20 * time.Millisecond,
+		RetryMaxDelay: 200 * time.Millisecond,
+	}
+	w := newPersistentWorker(0, cfg)
+
+	failures := make(chan batchFailure, 256)
+	drainDone := make(chan struct{})
+	go func() {
+		for range failures {
+		}
+		close(drainDone)
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go w.supervise(&wg, failures)
+
+	time.Sleep(300 * time.Millisecond)
+	w.shutdown.Store(true)
+	w.closeStdin()
+	waitTimeout(t, &wg, 2*time.Second)
+	close(failures)
+	<-drainDone
+
+	data, err := os.ReadFile(counter)
+	if err != nil {
+		t.Fatalf("reading respawn counter: %v", err)
+	}
+	var n int
+	if _, err := fmt.Sscanf(string(data), "%d", &n); err != nil {
+		t.Fatalf("parsing respawn counter %q: %v", data, err)
+	}
+	if n > 15 {
+		t.Fatalf("child ran %d times in 300ms, want a handful (backoff not throttling the crash loop)", n)
+	}
+	if n < 2 {
+		t.Fatalf("child ran %d times, want at least a couple of respawns to exercise the backoff at all", n)
+	}
+}
+
+// TestPersistentWorkerCleanExitRespawnsAreNotThrottled checks that the crash
+// backoff only applies to crashing children: a worker whose child exits 0
+// quickly on every respawn should respawn at full speed, not get throttled as
+// if it were a crash loop.
+func TestPersistentWorkerCleanExitRespawnsAreNotThrottled(t *testing.T) {
+	counter := scratchFile(t)
+	cfg := &Config{
+		Command:       []string{"bash", "-c", `n=$(cat "$1" 2>/dev/null || echo 0); echo $((n+1)) > "$1"`, "_", counter},
+		RetryDelay:    200 * time.Millisecond,
+		RetryMaxDelay: 2 * time.Second,
+	}
+	w := newPersistentWorker(0, cfg)
+
+	failures := make(chan batchFailure, 8)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go w.supervise(&wg, failures)
+
+	time.Sleep(300 * time.Millisecond)
+	w.shutdown.Store(true)
+	w.closeStdin()
+	waitTimeout(t, &wg, 2*time.Second)
+
+	data, err := os.ReadFile(counter)
+	if err != nil {
+		t.Fatalf("reading respawn counter: %v", err)
+	}
+	var n int
+	if _, err := fmt.Sscanf(string(data), "%d", &n); err != nil {
+		t.Fatalf("parsing respawn counter %q: %v", data, err)
+	}
+	if n < 10 {
+		t.Fatalf("clean-exit child only ran %d times in 300ms with a 200ms RetryDelay, want many more (crash backoff is wrongly throttling healthy exits)", n)
+	}
+}
+
+// TestPersistentWorkerShutdownDuringBackoffIsPrompt checks that shutting down
+// a worker while it is mid-backoff after a crash returns promptly instead of
+// blocking for the full (possibly multi-second) backoff delay.
+func TestPersistentWorkerShutdownDuringBackoffIsPrompt(t *testing.T) {
+	cfg := &Config{
+		Command:       []string{"false"},
+		RetryDelay:    5 * time.Second,
+		RetryMaxDelay: 5 * time.Second,
+	}
+	w := newPersistentWorker(0, cfg)
+
+	failures := make(chan batchFailure, 8)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go w.supervise(&wg, failures)
+
+	// Give the child time to die once and enter its backoff sleep.
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	w.shutdown.Store(true)
+	w.closeStdin()
+	waitTimeout(t, &wg, 2*time.Second)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("shutdown took %v, want it to not wait out the backoff delay", elapsed)
+	}
+}
+
+// TestPersistentWorkerAckProtocolReplaysUnackedLineOnRespawn drives a worker
+// through the ack protocol and confirms an unacked line is replayed to the
+// respawned child.
+func TestPersistentWorkerAckProtocolReplaysUnackedLineOnRespawn(t *testing.T) {
+	cfg := &Config{
+		AckProtocol: true,
+		// Echo the line and ack it, except die silently on "drop" so the
+		// worker has to respawn and replay it.
+		Command: []string{"bash", "-c", `while IFS= read -r line; do
+			if [ "$line" = "drop" ]; then exit 1; fi
+			echo "$line"
+			printf '\x01GPARALLEL-ACK\x01\n'
+		done`},
+	}
+	w := newPersistentWorker(0, cfg)
+
+	failures := make(chan batchFailure, 2)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go w.supervise(&wg, failures)
+
+	if err := w.send("drop"); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	select {
+	case <-failures:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the crash to be reported")
+	}
+
+	// The respawned child should have replayed "drop" and die on it again.
+	select {
+	case f := <-failures:
+		if len(f.inputLines) != 1 || f.inputLines[0] != "drop" {
+			t.Fatalf("inputLines = %v, want [drop] replayed after respawn", f.inputLines)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the replayed line to fail again")
+	}
+
+	w.shutdown.Store(true)
+	w.closeStdin()
+	waitTimeout(t, &wg, 2*time.Second)
+}
+
+// TestConsumeAcksSurfacesScannerError checks that a read error on the ack
+// stream is reported to stderr instead of being dropped silently.
+func TestConsumeAcksSurfacesScannerError(t *testing.T) {
+	w := &persistentWorker{id: 0, cfg: &Config{}}
+
+	r, stderrOut := captureConsumeAcksStderr(t, w)
+	if !bytes.Contains(stderrOut, []byte("reading ack stream")) {
+		t.Fatalf("stderr = %q, want it to mention the scanner error", stderrOut)
+	}
+	_ = r
+}
+
+// errReader always fails with a fixed error, simulating a broken ack pipe.
+type errReader struct{ err error }
+
+func (e errReader) Read([]byte) (int, error) { return 0, e.err }
+
+func captureConsumeAcksStderr(t *testing.T, w *persistentWorker) (io.Reader, []byte) {
+	t.Helper()
+	r, wr, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("os.Pipe: %v", err)
+	}
+	orig := os.Stderr
+	os.Stderr = wr
+	defer func() { os.Stderr = orig }()
+
+	w.consumeAcks(errReader{err: exec.ErrNotFound})
+
+	_ = wr.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading captured stderr: %v", err)
+	}
+	return r, out
+}
+
+// waitTimeout waits for wg to finish or fails the test after timeout.
+func waitTimeout(t *testing.T, wg *sync.WaitGroup, timeout time.Duration) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for supervise to return")
+	}
+}
+
+// scratchFile returns a fresh temp file path for a test to use as scratch state.
+func scratchFile(t *testing.T) string {
+	t.Helper()
+	f, err := os.CreateTemp("", "gparallel-test-*")
+	if err != nil {
+		t.Fatalf("CreateTemp: %v", err)
+	}
+	name := f.Name()
+	_ = f.Close()
+	t.Cleanup(func() { _ = os.Remove(name) })
+	return name
+}